@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwk is a single entry of a JWKS document, RFC 7517. Only the fields
+// needed to reconstruct an RSA public key are kept.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jwksDocument struct {
+	Keys []jwk `json:"keys"`
+}
+
+// jwksCache fetches and caches an IdP's JSON Web Key Set, keyed by kid,
+// refetching on a cache miss so key rotation doesn't require a restart.
+type jwksCache struct {
+	mu        sync.RWMutex
+	uri       string
+	keys      map[string]*rsa.PublicKey
+	lastFetch time.Time
+	rootCAs   string
+	verbose   int
+}
+
+// newJWKSCache builds a jwksCache for the given jwks_uri.
+func newJWKSCache(uri, rootCAs string, verbose int) *jwksCache {
+	return &jwksCache{uri: uri, keys: map[string]*rsa.PublicKey{}, rootCAs: rootCAs, verbose: verbose}
+}
+
+// refresh re-fetches the JWKS document and replaces the cached key set.
+func (c *jwksCache) refresh() error {
+	client := &http.Client{}
+	if tr, err := Transport(c.rootCAs, c.verbose); err == nil {
+		client = &http.Client{Transport: tr}
+	}
+	resp, err := client.Get(c.uri)
+	if err != nil {
+		return fmt.Errorf("unable to fetch JWKS from %s, error: %v", c.uri, err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var doc jwksDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("unable to parse JWKS from %s, error: %v", c.uri, err)
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range doc.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		pub, err := rsaPublicKeyFromJWK(k.N, k.E)
+		if err != nil {
+			if c.verbose > 1 {
+				log.Printf("skipping JWKS entry %s: %v", k.Kid, err)
+			}
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	c.mu.Lock()
+	c.keys = keys
+	c.lastFetch = time.Now()
+	c.mu.Unlock()
+	if c.verbose > 1 {
+		log.Printf("refreshed JWKS from %s, %d keys", c.uri, len(keys))
+	}
+	return nil
+}
+
+// keyFunc is a jwt.Keyfunc: it looks up the key for the token's kid,
+// refreshing the cache once on a miss to pick up newly rotated keys.
+func (c *jwksCache) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	c.mu.RLock()
+	key, ok := c.keys[kid]
+	c.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if err := c.refresh(); err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	key, ok = c.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("no JWKS key found for kid %q", kid)
+	}
+	return key, nil
+}
+
+// rsaPublicKeyFromJWK reconstructs an *rsa.PublicKey from the base64url
+// encoded modulus (n) and exponent (e) of an RSA JWK.
+func rsaPublicKeyFromJWK(nEnc, eEnc string) (*rsa.PublicKey, error) {
+	nBytes, err := base64.RawURLEncoding.DecodeString(nEnc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %v", err)
+	}
+	eBytes, err := base64.RawURLEncoding.DecodeString(eEnc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent: %v", err)
+	}
+	padded := make([]byte, 8)
+	copy(padded[8-len(eBytes):], eBytes)
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nBytes),
+		E: int(binary.BigEndian.Uint64(padded)),
+	}, nil
+}
+
+// parseToken verifies rawToken's signature against jwks and its
+// exp/nbf/iss claims, returning the decoded claims.
+func parseToken(rawToken string, jwks *jwksCache, issuer string) (jwt.MapClaims, error) {
+	if rawToken == "" {
+		return nil, fmt.Errorf("empty token")
+	}
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512"}),
+		jwt.WithExpirationRequired(),
+	}
+	if issuer != "" {
+		opts = append(opts, jwt.WithIssuer(issuer))
+	}
+	token, err := jwt.Parse(rawToken, jwks.keyFunc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, fmt.Errorf("unexpected claims type %T", token.Claims)
+	}
+	return claims, nil
+}
+
+// ParseAccessToken verifies rec.AccessToken and stores its claims on
+// rec.AccessClaims.
+func ParseAccessToken(rec *TokenRecord, jwks *jwksCache, issuer string, verbose int) error {
+	claims, err := parseToken(rec.AccessToken, jwks, issuer)
+	if err != nil {
+		return fmt.Errorf("access token validation failed: %v", err)
+	}
+	rec.AccessClaims = claims
+	if verbose > 0 {
+		printClaims("access_token", claims)
+	}
+	return nil
+}
+
+// ParseIdToken verifies rec.IdToken and stores its claims on
+// rec.IDClaims.
+func ParseIdToken(rec *TokenRecord, jwks *jwksCache, issuer string, verbose int) error {
+	if rec.IdToken == "" {
+		return nil
+	}
+	claims, err := parseToken(rec.IdToken, jwks, issuer)
+	if err != nil {
+		return fmt.Errorf("id token validation failed: %v", err)
+	}
+	rec.IDClaims = claims
+	if verbose > 0 {
+		printClaims("id_token", claims)
+	}
+	return nil
+}
+
+func printClaims(label string, claims jwt.MapClaims) {
+	data, err := json.MarshalIndent(claims, "", "    ")
+	if err != nil {
+		log.Printf("unable to marshal %s claims: %v", label, err)
+		return
+	}
+	log.Printf("decoded %s payload:\n%s", label, string(data))
+}
+
+// scopesOf returns the space-delimited scopes of the token, checking
+// both the "scope" (OAuth2) and "scp" (some IdPs) claims.
+func scopesOf(claims jwt.MapClaims) []string {
+	for _, key := range []string{"scope", "scp"} {
+		if v, ok := claims[key]; ok {
+			if s, ok := v.(string); ok {
+				return strings.Fields(s)
+			}
+		}
+	}
+	return nil
+}
+
+// audiencesOf returns the token's aud claim, which per RFC 7519 may be
+// either a single string or an array of strings.
+func audiencesOf(claims jwt.MapClaims) []string {
+	v, ok := claims["aud"]
+	if !ok {
+		return nil
+	}
+	switch aud := v.(type) {
+	case string:
+		return []string{aud}
+	case []interface{}:
+		var out []string
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func contains(list []string, want string) bool {
+	for _, v := range list {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
+
+// multiFlag collects repeated occurrences of a string flag, e.g.
+// -requireScope storage.read:/ -requireScope storage.modify:/.
+type multiFlag []string
+
+func (m *multiFlag) String() string {
+	return strings.Join(*m, ",")
+}
+
+func (m *multiFlag) Set(v string) error {
+	*m = append(*m, v)
+	return nil
+}
+
+// parseRequireClaims turns a list of "key=value" strings (from repeated
+// -requireClaim flags) into a map, erroring on malformed entries.
+func parseRequireClaims(entries []string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, e := range entries {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid -requireClaim %q, expected key=value", e)
+		}
+		out[parts[0]] = parts[1]
+	}
+	return out, nil
+}
+
+// checkRequirements enforces -requireScope, -requireAudience and
+// -requireClaim against the access token's claims, so the daemon can
+// fail fast when the IdP hands back a token missing required
+// entitlements (e.g. WLCG-profile scopes like storage.read:/).
+func checkRequirements(claims jwt.MapClaims, requireScope, requireAudience []string, requireClaim map[string]string) error {
+	if claims == nil {
+		if len(requireScope) > 0 || len(requireAudience) > 0 || len(requireClaim) > 0 {
+			return fmt.Errorf("token has no verified claims to check requirements against")
+		}
+		return nil
+	}
+	scopes := scopesOf(claims)
+	for _, want := range requireScope {
+		if !contains(scopes, want) {
+			return fmt.Errorf("required scope %q not present in token (have: %v)", want, scopes)
+		}
+	}
+	audiences := audiencesOf(claims)
+	for _, want := range requireAudience {
+		if !contains(audiences, want) {
+			return fmt.Errorf("required audience %q not present in token (have: %v)", want, audiences)
+		}
+	}
+	for key, want := range requireClaim {
+		got, ok := claims[key]
+		if !ok || fmt.Sprintf("%v", got) != want {
+			return fmt.Errorf("required claim %s=%q not satisfied (have: %v)", key, want, got)
+		}
+	}
+	return nil
+}
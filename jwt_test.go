@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signRS256 signs claims with priv under kid, as an IdP's JWKS-backed
+// token endpoint would.
+func signRS256(t *testing.T, priv *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(priv)
+	if err != nil {
+		t.Fatalf("unable to sign token: %v", err)
+	}
+	return signed
+}
+
+func TestRsaPublicKeyFromJWK(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate RSA key: %v", err)
+	}
+	nEnc := base64.RawURLEncoding.EncodeToString(priv.PublicKey.N.Bytes())
+	eBytes := []byte{0x01, 0x00, 0x01} // 65537
+	eEnc := base64.RawURLEncoding.EncodeToString(eBytes)
+
+	pub, err := rsaPublicKeyFromJWK(nEnc, eEnc)
+	if err != nil {
+		t.Fatalf("rsaPublicKeyFromJWK returned error: %v", err)
+	}
+	if pub.E != priv.PublicKey.E {
+		t.Errorf("got exponent %d, want %d", pub.E, priv.PublicKey.E)
+	}
+	if pub.N.Cmp(priv.PublicKey.N) != 0 {
+		t.Errorf("got modulus %v, want %v", pub.N, priv.PublicKey.N)
+	}
+}
+
+func TestRsaPublicKeyFromJWKInvalidInput(t *testing.T) {
+	if _, err := rsaPublicKeyFromJWK("not-base64!", "AQAB"); err == nil {
+		t.Error("expected an error for an invalid modulus")
+	}
+	if _, err := rsaPublicKeyFromJWK(base64.RawURLEncoding.EncodeToString([]byte{1}), "not-base64!"); err == nil {
+		t.Error("expected an error for an invalid exponent")
+	}
+}
+
+func TestScopesOf(t *testing.T) {
+	if got := scopesOf(jwt.MapClaims{"scope": "storage.read:/ storage.modify:/"}); len(got) != 2 {
+		t.Errorf("expected 2 scopes from the scope claim, got %v", got)
+	}
+	if got := scopesOf(jwt.MapClaims{"scp": "openid profile"}); len(got) != 2 {
+		t.Errorf("expected 2 scopes from the scp claim, got %v", got)
+	}
+	if got := scopesOf(jwt.MapClaims{}); got != nil {
+		t.Errorf("expected nil scopes when neither claim is present, got %v", got)
+	}
+}
+
+func TestAudiencesOf(t *testing.T) {
+	if got := audiencesOf(jwt.MapClaims{"aud": "api"}); len(got) != 1 || got[0] != "api" {
+		t.Errorf("expected a single audience %q, got %v", "api", got)
+	}
+	if got := audiencesOf(jwt.MapClaims{"aud": []interface{}{"api", "storage"}}); len(got) != 2 {
+		t.Errorf("expected two audiences, got %v", got)
+	}
+	if got := audiencesOf(jwt.MapClaims{}); got != nil {
+		t.Errorf("expected nil audiences when aud is absent, got %v", got)
+	}
+}
+
+func TestCheckRequirements(t *testing.T) {
+	claims := jwt.MapClaims{
+		"scope": "storage.read:/",
+		"aud":   "https://storage.example",
+		"group": "admins",
+	}
+	if err := checkRequirements(claims, []string{"storage.read:/"}, []string{"https://storage.example"}, map[string]string{"group": "admins"}); err != nil {
+		t.Errorf("expected satisfied requirements to pass, got error: %v", err)
+	}
+	if err := checkRequirements(claims, []string{"storage.modify:/"}, nil, nil); err == nil {
+		t.Error("expected missing scope to be rejected")
+	}
+	if err := checkRequirements(claims, nil, []string{"https://other.example"}, nil); err == nil {
+		t.Error("expected missing audience to be rejected")
+	}
+	if err := checkRequirements(claims, nil, nil, map[string]string{"group": "users"}); err == nil {
+		t.Error("expected mismatched claim to be rejected")
+	}
+	if err := checkRequirements(nil, []string{"storage.read:/"}, nil, nil); err == nil {
+		t.Error("expected nil claims with requirements configured to be rejected")
+	}
+	if err := checkRequirements(nil, nil, nil, nil); err != nil {
+		t.Errorf("expected nil claims with no requirements to pass, got error: %v", err)
+	}
+}
+
+func TestParseTokenRequiresExpiration(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate RSA key: %v", err)
+	}
+	jwks := newJWKSCache("", "", 0)
+	jwks.keys = map[string]*rsa.PublicKey{"kid1": &priv.PublicKey}
+
+	withExp := signRS256(t, priv, "kid1", jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()})
+	if _, err := parseToken(withExp, jwks, ""); err != nil {
+		t.Errorf("expected a token with exp to be accepted, got error: %v", err)
+	}
+
+	noExp := signRS256(t, priv, "kid1", jwt.MapClaims{"sub": "someone"})
+	if _, err := parseToken(noExp, jwks, ""); err == nil {
+		t.Error("expected a token with no exp claim to be rejected")
+	}
+}
+
+func TestParseRequireClaims(t *testing.T) {
+	got, err := parseRequireClaims([]string{"group=admins", "env=prod"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got["group"] != "admins" || got["env"] != "prod" {
+		t.Errorf("unexpected parsed claims: %v", got)
+	}
+	if _, err := parseRequireClaims([]string{"malformed"}); err == nil {
+		t.Error("expected an error for a malformed entry with no '='")
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// OIDCDiscovery represents the subset of the OIDC discovery document
+// (.well-known/openid-configuration) we need to drive the various grants.
+type OIDCDiscovery struct {
+	Issuer                      string `json:"issuer"`
+	TokenEndpoint               string `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	AuthorizationEndpoint       string `json:"authorization_endpoint"`
+	JwksURI                     string `json:"jwks_uri"`
+}
+
+// Discover fetches the OIDC discovery document for the given issuer URL.
+func Discover(issuer string, rootCAs string, verbose int) (OIDCDiscovery, error) {
+	var disc OIDCDiscovery
+	uri := strings.TrimRight(issuer, "/") + "/.well-known/openid-configuration"
+	client := &http.Client{}
+	tr, err := Transport(rootCAs, verbose)
+	if err == nil {
+		client = &http.Client{Transport: tr}
+	}
+	resp, err := client.Get(uri)
+	if err != nil {
+		return disc, fmt.Errorf("unable to fetch discovery document from %s, error: %v", uri, err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return disc, fmt.Errorf("unable to read discovery document, error: %v", err)
+	}
+	if err := json.Unmarshal(data, &disc); err != nil {
+		return disc, fmt.Errorf("unable to parse discovery document, error: %v", err)
+	}
+	if verbose > 1 {
+		log.Printf("OIDC discovery for %s: %+v", issuer, disc)
+	}
+	return disc, nil
+}
+
+// Provider is implemented by every supported OAuth2/OIDC grant flow and
+// produces a TokenRecord from the IdP's token endpoint.
+type Provider interface {
+	// Grant performs the token request and returns the resulting record.
+	Grant() (TokenRecord, error)
+}
+
+// providerClient holds the bits shared by all providers: the token
+// endpoint to post to, the HTTP transport and the verbosity level.
+type providerClient struct {
+	tokenEndpoint string
+	client        *http.Client
+	verbose       int
+}
+
+func newProviderClient(disc OIDCDiscovery, rootCAs string, verbose int) providerClient {
+	client := &http.Client{}
+	if tr, err := Transport(rootCAs, verbose); err == nil {
+		client = &http.Client{Transport: tr}
+	}
+	return providerClient{tokenEndpoint: disc.TokenEndpoint, client: client, verbose: verbose}
+}
+
+// postForm posts the given form values to the token endpoint and decodes
+// the JSON response into a TokenRecord.
+func (p providerClient) postForm(form url.Values) (TokenRecord, error) {
+	var rec TokenRecord
+	req, err := http.NewRequest("POST", p.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return rec, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.verbose > 1 {
+		log.Printf("POST %s form=%v", p.tokenEndpoint, form)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return rec, fmt.Errorf("unable to reach token endpoint %s, error: %v", p.tokenEndpoint, err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return rec, err
+	}
+	if resp.StatusCode >= 400 {
+		return rec, fmt.Errorf("token endpoint %s returned %d: %s", p.tokenEndpoint, resp.StatusCode, string(data))
+	}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return rec, fmt.Errorf("unable to parse token response, error: %v", err)
+	}
+	return rec, nil
+}
+
+// grant discovers the issuer's OIDC endpoints and runs the requested
+// grant type against them, returning the resulting TokenRecord.
+func grant(issuer, grantType, clientID, clientSecret, username, password, scope, token, rootCAs string, verbose int) (TokenRecord, error) {
+	var rec TokenRecord
+	disc, err := Discover(issuer, rootCAs, verbose)
+	if err != nil {
+		return rec, err
+	}
+	pc := newProviderClient(disc, rootCAs, verbose)
+	var p Provider
+	switch grantType {
+	case "refresh_token":
+		p = RefreshTokenProvider{providerClient: pc, ClientID: clientID, ClientSecret: clientSecret, RefreshToken: ReadToken(token)}
+	case "client_credentials":
+		p = ClientCredentialsProvider{providerClient: pc, ClientID: clientID, ClientSecret: clientSecret, Scope: scope}
+	case "password":
+		p = PasswordProvider{providerClient: pc, ClientID: clientID, ClientSecret: clientSecret, Username: username, Password: password, Scope: scope}
+	case "device_code":
+		if disc.DeviceAuthorizationEndpoint == "" {
+			return rec, fmt.Errorf("issuer %s does not advertise a device_authorization_endpoint", issuer)
+		}
+		p = DeviceCodeProvider{providerClient: pc, DeviceAuthorizationEndpoint: disc.DeviceAuthorizationEndpoint, ClientID: clientID, ClientSecret: clientSecret, Scope: scope}
+	default:
+		return rec, fmt.Errorf("unsupported grantType %q", grantType)
+	}
+	return p.Grant()
+}
+
+// RefreshTokenProvider performs the refresh_token grant, i.e. the flow
+// TokenManager originally supported via /token/renew.
+type RefreshTokenProvider struct {
+	providerClient
+	ClientID     string
+	ClientSecret string
+	RefreshToken string
+}
+
+// Grant implements Provider.
+func (p RefreshTokenProvider) Grant() (TokenRecord, error) {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", p.RefreshToken)
+	if p.ClientID != "" {
+		form.Set("client_id", p.ClientID)
+	}
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+	return p.postForm(form)
+}
+
+// ClientCredentialsProvider performs the client_credentials grant, used
+// by headless service accounts that have no associated user.
+type ClientCredentialsProvider struct {
+	providerClient
+	ClientID     string
+	ClientSecret string
+	Scope        string
+}
+
+// Grant implements Provider.
+func (p ClientCredentialsProvider) Grant() (TokenRecord, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", p.ClientID)
+	form.Set("client_secret", p.ClientSecret)
+	if p.Scope != "" {
+		form.Set("scope", p.Scope)
+	}
+	return p.postForm(form)
+}
+
+// PasswordProvider performs the (deprecated but still common) Resource
+// Owner Password Credentials grant.
+type PasswordProvider struct {
+	providerClient
+	ClientID     string
+	ClientSecret string
+	Username     string
+	Password     string
+	Scope        string
+}
+
+// Grant implements Provider.
+func (p PasswordProvider) Grant() (TokenRecord, error) {
+	form := url.Values{}
+	form.Set("grant_type", "password")
+	form.Set("client_id", p.ClientID)
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+	form.Set("username", p.Username)
+	form.Set("password", p.Password)
+	if p.Scope != "" {
+		form.Set("scope", p.Scope)
+	}
+	return p.postForm(form)
+}
+
+// tokenExchanger performs an RFC 8693 token exchange, swapping a subject
+// token for one scoped to a different audience. Used by -serve mode to
+// satisfy GET /token?audience=....
+type tokenExchanger struct {
+	providerClient
+	ClientID     string
+	ClientSecret string
+}
+
+// Exchange implements the subject_token -> audience-scoped token swap.
+// accessToken is used as the subject token rather than the refresh
+// token since client_credentials grants (-serve's primary use case)
+// commonly return no refresh token at all.
+func (p tokenExchanger) Exchange(accessToken, audience string) (TokenRecord, error) {
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:token-exchange")
+	form.Set("subject_token", accessToken)
+	form.Set("subject_token_type", "urn:ietf:params:oauth:token-type:access_token")
+	form.Set("audience", audience)
+	if p.ClientID != "" {
+		form.Set("client_id", p.ClientID)
+	}
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+	return p.postForm(form)
+}
+
+// deviceAuthResponse is the response from the device authorization
+// endpoint, RFC 8628 section 3.2.
+type deviceAuthResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// DeviceCodeProvider performs the RFC 8628 device authorization grant,
+// suitable for CLIs and other browser-less clients.
+type DeviceCodeProvider struct {
+	providerClient
+	DeviceAuthorizationEndpoint string
+	ClientID                    string
+	ClientSecret                string
+	Scope                       string
+}
+
+// Grant implements Provider. It starts the device authorization flow,
+// prints the user_code/verification_uri for the user to visit, then
+// polls the token endpoint honoring authorization_pending/slow_down.
+func (p DeviceCodeProvider) Grant() (TokenRecord, error) {
+	var rec TokenRecord
+	form := url.Values{}
+	form.Set("client_id", p.ClientID)
+	if p.Scope != "" {
+		form.Set("scope", p.Scope)
+	}
+	req, err := http.NewRequest("POST", p.DeviceAuthorizationEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return rec, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return rec, fmt.Errorf("unable to reach device authorization endpoint %s, error: %v", p.DeviceAuthorizationEndpoint, err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return rec, err
+	}
+	var auth deviceAuthResponse
+	if err := json.Unmarshal(data, &auth); err != nil {
+		return rec, fmt.Errorf("unable to parse device authorization response, error: %v", err)
+	}
+	if auth.VerificationURIComplete != "" {
+		fmt.Printf("To authenticate, visit: %s\n", auth.VerificationURIComplete)
+	} else {
+		fmt.Printf("To authenticate, visit: %s and enter code: %s\n", auth.VerificationURI, auth.UserCode)
+	}
+	interval := auth.Interval
+	if interval <= 0 {
+		interval = 5
+	}
+	deadline := time.Now().Add(time.Duration(auth.ExpiresIn) * time.Second)
+	pollForm := url.Values{}
+	pollForm.Set("grant_type", "urn:ietf:params:oauth:grant-type:device_code")
+	pollForm.Set("device_code", auth.DeviceCode)
+	pollForm.Set("client_id", p.ClientID)
+	if p.ClientSecret != "" {
+		pollForm.Set("client_secret", p.ClientSecret)
+	}
+	for {
+		if time.Now().After(deadline) {
+			return rec, fmt.Errorf("device code expired before authorization completed")
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+		rec, err = p.postForm(pollForm)
+		if err == nil {
+			return rec, nil
+		}
+		msg := err.Error()
+		if strings.Contains(msg, "authorization_pending") {
+			continue
+		}
+		if strings.Contains(msg, "slow_down") {
+			interval += 5
+			continue
+		}
+		return rec, err
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDiscover(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/openid-configuration" {
+			t.Errorf("unexpected discovery path %s", r.URL.Path)
+		}
+		json.NewEncoder(w).Encode(OIDCDiscovery{
+			Issuer:        "https://idp.example",
+			TokenEndpoint: "https://idp.example/token",
+		})
+	}))
+	defer srv.Close()
+
+	disc, err := Discover(srv.URL, "", 0)
+	if err != nil {
+		t.Fatalf("Discover returned error: %v", err)
+	}
+	if disc.TokenEndpoint != "https://idp.example/token" {
+		t.Errorf("unexpected token endpoint %q", disc.TokenEndpoint)
+	}
+}
+
+// tokenServer returns an httptest.Server that checks each request's
+// grant_type against wantGrantType and responds with the given status
+// and the JSON-encoded body.
+func tokenServer(t *testing.T, wantGrantType string, status int, body interface{}) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatalf("unable to parse form: %v", err)
+		}
+		if got := r.PostForm.Get("grant_type"); got != wantGrantType {
+			t.Errorf("grant_type = %q, want %q", got, wantGrantType)
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}))
+}
+
+func TestRefreshTokenProviderGrant(t *testing.T) {
+	srv := tokenServer(t, "refresh_token", http.StatusOK, TokenRecord{AccessToken: "at"})
+	defer srv.Close()
+
+	p := RefreshTokenProvider{providerClient: providerClient{tokenEndpoint: srv.URL, client: srv.Client()}, RefreshToken: "rt"}
+	rec, err := p.Grant()
+	if err != nil {
+		t.Fatalf("Grant returned error: %v", err)
+	}
+	if rec.AccessToken != "at" {
+		t.Errorf("AccessToken = %q, want %q", rec.AccessToken, "at")
+	}
+}
+
+func TestClientCredentialsProviderGrant(t *testing.T) {
+	srv := tokenServer(t, "client_credentials", http.StatusOK, TokenRecord{AccessToken: "at"})
+	defer srv.Close()
+
+	p := ClientCredentialsProvider{providerClient: providerClient{tokenEndpoint: srv.URL, client: srv.Client()}, ClientID: "id", ClientSecret: "secret"}
+	if _, err := p.Grant(); err != nil {
+		t.Fatalf("Grant returned error: %v", err)
+	}
+}
+
+func TestPasswordProviderGrant(t *testing.T) {
+	srv := tokenServer(t, "password", http.StatusOK, TokenRecord{AccessToken: "at"})
+	defer srv.Close()
+
+	p := PasswordProvider{providerClient: providerClient{tokenEndpoint: srv.URL, client: srv.Client()}, Username: "u", Password: "p"}
+	if _, err := p.Grant(); err != nil {
+		t.Fatalf("Grant returned error: %v", err)
+	}
+}
+
+func TestPostFormErrorStatus(t *testing.T) {
+	srv := tokenServer(t, "refresh_token", http.StatusUnauthorized, map[string]string{"error": "invalid_grant"})
+	defer srv.Close()
+
+	p := RefreshTokenProvider{providerClient: providerClient{tokenEndpoint: srv.URL, client: srv.Client()}, RefreshToken: "rt"}
+	if _, err := p.Grant(); err == nil {
+		t.Error("expected an error for a 401 response")
+	}
+}
+
+func TestTokenExchangerExchange(t *testing.T) {
+	srv := tokenServer(t, "urn:ietf:params:oauth:grant-type:token-exchange", http.StatusOK, TokenRecord{AccessToken: "exchanged"})
+	defer srv.Close()
+
+	ex := tokenExchanger{providerClient: providerClient{tokenEndpoint: srv.URL, client: srv.Client()}, ClientID: "id"}
+	rec, err := ex.Exchange("access-token", "https://api.example")
+	if err != nil {
+		t.Fatalf("Exchange returned error: %v", err)
+	}
+	if rec.AccessToken != "exchanged" {
+		t.Errorf("AccessToken = %q, want %q", rec.AccessToken, "exchanged")
+	}
+}
+
+func TestDeviceCodeProviderGrant(t *testing.T) {
+	var polls int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(deviceAuthResponse{
+			DeviceCode:      "devcode",
+			UserCode:        "ABCD",
+			VerificationURI: "https://idp.example/device",
+			ExpiresIn:       30,
+			Interval:        1,
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		if polls == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "authorization_pending"})
+			return
+		}
+		json.NewEncoder(w).Encode(TokenRecord{AccessToken: "at"})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	p := DeviceCodeProvider{
+		providerClient:              providerClient{tokenEndpoint: srv.URL + "/token", client: srv.Client()},
+		DeviceAuthorizationEndpoint: srv.URL + "/device",
+		ClientID:                    "id",
+	}
+	rec, err := p.Grant()
+	if err != nil {
+		t.Fatalf("Grant returned error: %v", err)
+	}
+	if rec.AccessToken != "at" {
+		t.Errorf("AccessToken = %q, want %q", rec.AccessToken, "at")
+	}
+	if polls != 2 {
+		t.Errorf("expected 2 polls (one pending, one success), got %d", polls)
+	}
+}
+
+func TestGrantUnsupportedGrantType(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(OIDCDiscovery{Issuer: "https://idp.example", TokenEndpoint: "https://idp.example/token"})
+	}))
+	defer srv.Close()
+
+	if _, err := grant(srv.URL, "bogus", "", "", "", "", "", "", "", 0); err == nil {
+		t.Error("expected an error for an unsupported grantType")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"time"
+)
+
+// exitRefreshTokenExpired is returned by main when the refresh token is
+// about to reach its own expiry and re-running the initial grant is not
+// possible (e.g. an interactive grant was used), so a supervisor needs
+// to intervene.
+const exitRefreshTokenExpired = 3
+
+// minRefreshDelay is the floor applied to a computed refresh delay so a
+// mis-configured or zero expires_in can't spin the scheduler in a tight
+// loop against the IdP.
+const minRefreshDelay = time.Second
+
+// nextRefreshDelay computes how long to sleep before the next proactive
+// refresh: refreshRatio of the access token's remaining lifetime (e.g.
+// 2/3 means refresh once two thirds of the lifetime has elapsed), with
+// +/-10% jitter so many co-located managers sharing an IdP don't all
+// wake up at once.
+func nextRefreshDelay(rec TokenRecord, refreshRatio float64, fallback time.Duration) time.Duration {
+	lifetime := time.Duration(rec.AccessTokenExpire) * time.Second
+	if lifetime <= 0 {
+		if fallback < minRefreshDelay {
+			fallback = minRefreshDelay
+		}
+		return fallback
+	}
+	base := time.Duration(float64(lifetime) * refreshRatio)
+	jitter := time.Duration((rand.Float64()*0.2 - 0.1) * float64(base))
+	d := base + jitter
+	if d < minRefreshDelay {
+		d = minRefreshDelay
+	}
+	return d
+}
+
+// backoffDelay computes the delay before retrying a failed refresh,
+// doubling with each attempt (1s, 2s, 4s, ...) and capped at maxBackoff.
+func backoffDelay(attempt int, maxBackoff time.Duration) time.Duration {
+	if attempt < 0 {
+		attempt = 0
+	}
+	if attempt > 30 { // avoid overflowing the shift
+		attempt = 30
+	}
+	d := time.Duration(1<<uint(attempt)) * time.Second
+	if d <= 0 || d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// refreshTokenExpiringSoon reports whether the refresh token obtained at
+// issuedAt will reach its RefreshTokenExpire within margin.
+func refreshTokenExpiringSoon(rec TokenRecord, issuedAt time.Time, margin time.Duration) bool {
+	if rec.RefreshTokenExpire <= 0 {
+		return false
+	}
+	expiry := issuedAt.Add(time.Duration(rec.RefreshTokenExpire) * time.Second)
+	return time.Now().Add(margin).After(expiry)
+}
+
+// runScheduler drives the proactive refresh loop: it refreshes at
+// refreshRatio of the access token lifetime, retries failures with
+// capped exponential backoff, and exits with exitRefreshTokenExpired
+// when the refresh token itself is about to expire and reinit is nil
+// (no way to re-run the initial grant automatically).
+func runScheduler(rec TokenRecord, refreshRatio float64, fallbackInterval, maxBackoff time.Duration, renew func(refreshToken string) (TokenRecord, error), reinit func() (TokenRecord, error), onRenew func(TokenRecord), exit func(code int)) {
+	issuedAt := time.Now()
+	attempt := 0
+	for {
+		delay := nextRefreshDelay(rec, refreshRatio, fallbackInterval)
+		if attempt > 0 {
+			delay = backoffDelay(attempt, maxBackoff)
+			// never back off past the refresh token's own expiry
+			if rec.RefreshTokenExpire > 0 {
+				left := time.Until(issuedAt.Add(time.Duration(rec.RefreshTokenExpire) * time.Second))
+				if left < delay {
+					delay = left
+				}
+			}
+		}
+		time.Sleep(delay)
+
+		if refreshTokenExpiringSoon(rec, issuedAt, delay) {
+			if reinit != nil {
+				log.Println("refresh token is about to expire, re-running initial grant")
+				newRec, err := reinit()
+				if err != nil {
+					log.Printf("unable to re-run initial grant: %v", err)
+					attempt++
+					continue
+				}
+				rec = newRec
+				issuedAt = time.Now()
+				attempt = 0
+				onRenew(rec)
+				continue
+			}
+			log.Println("refresh token is about to expire and no reinit grant is configured, exiting")
+			exit(exitRefreshTokenExpired)
+			return
+		}
+
+		newRec, err := renew(rec.RefreshToken)
+		if err != nil {
+			attempt++
+			log.Printf("refresh failed (attempt %d): %v, retrying with backoff", attempt, err)
+			continue
+		}
+		rec = newRec
+		issuedAt = time.Now()
+		attempt = 0
+		onRenew(rec)
+	}
+}
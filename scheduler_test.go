@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextRefreshDelayZeroLifetimeFallsBack(t *testing.T) {
+	rec := TokenRecord{AccessTokenExpire: 0}
+	d := nextRefreshDelay(rec, 0.5, 30*time.Second)
+	if d != 30*time.Second {
+		t.Errorf("expected fallback of 30s for zero lifetime, got %v", d)
+	}
+}
+
+func TestNextRefreshDelayFallsBelowMinRefreshDelay(t *testing.T) {
+	rec := TokenRecord{AccessTokenExpire: 0}
+	d := nextRefreshDelay(rec, 0.5, time.Millisecond)
+	if d != minRefreshDelay {
+		t.Errorf("expected fallback to be floored at minRefreshDelay, got %v", d)
+	}
+}
+
+func TestNextRefreshDelayWithinJitterBounds(t *testing.T) {
+	rec := TokenRecord{AccessTokenExpire: 1000}
+	base := time.Duration(1000*0.5) * time.Second
+	for i := 0; i < 20; i++ {
+		d := nextRefreshDelay(rec, 0.5, time.Second)
+		if d < base*9/10 || d > base*11/10 {
+			t.Fatalf("delay %v outside +/-10%% jitter of base %v", d, base)
+		}
+	}
+}
+
+func TestBackoffDelayDoublesAndCaps(t *testing.T) {
+	max := 10 * time.Second
+	cases := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{3, 8 * time.Second},
+		{4, max}, // would be 16s, capped
+		{-1, time.Second},
+	}
+	for _, c := range cases {
+		if got := backoffDelay(c.attempt, max); got != c.want {
+			t.Errorf("backoffDelay(%d, %v) = %v, want %v", c.attempt, max, got, c.want)
+		}
+	}
+}
+
+func TestRefreshTokenExpiringSoon(t *testing.T) {
+	rec := TokenRecord{RefreshTokenExpire: 60}
+	issuedAt := time.Now().Add(-50 * time.Second)
+	if !refreshTokenExpiringSoon(rec, issuedAt, 20*time.Second) {
+		t.Error("expected refresh token with 10s left to be reported as expiring soon under a 20s margin")
+	}
+	if refreshTokenExpiringSoon(rec, issuedAt, time.Second) {
+		t.Error("did not expect refresh token with 10s left to be reported as expiring soon under a 1s margin")
+	}
+}
+
+func TestRefreshTokenExpiringSoonNoExpiry(t *testing.T) {
+	rec := TokenRecord{RefreshTokenExpire: 0}
+	if refreshTokenExpiringSoon(rec, time.Now(), time.Hour) {
+		t.Error("a refresh token with no expiry should never be reported as expiring soon")
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	refreshTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tokenmanager_refresh_total",
+		Help: "Count of token refresh attempts, labeled by result (success|failure).",
+	}, []string{"result"})
+	tokenTTLGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tokenmanager_token_ttl_seconds",
+		Help: "Seconds remaining until the current access token expires.",
+	})
+	idpLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tokenmanager_idp_request_duration_seconds",
+		Help:    "Latency of HTTP requests made to the IdP.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+// Server turns TokenManager into a local credential broker: co-located
+// processes fetch the current token over a Unix socket (or loopback TCP
+// with mTLS) instead of each running their own refresh loop.
+type Server struct {
+	mu       sync.RWMutex
+	rec      TokenRecord
+	issuedAt time.Time
+	rootCAs  string
+	verbose  int
+	exchange func(accessToken, audience string) (TokenRecord, error)
+}
+
+// NewServer builds a Server. exchange, when non-nil, performs an RFC
+// 8693 token exchange against the IdP for the requested audience.
+func NewServer(rec TokenRecord, rootCAs string, verbose int, exchange func(accessToken, audience string) (TokenRecord, error)) *Server {
+	return &Server{rec: rec, issuedAt: time.Now(), rootCAs: rootCAs, verbose: verbose, exchange: exchange}
+}
+
+// UpdateRecord replaces the currently served TokenRecord, called after
+// every successful refresh.
+func (s *Server) UpdateRecord(rec TokenRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rec = rec
+	s.issuedAt = time.Now()
+	tokenTTLGauge.Set(float64(rec.AccessTokenExpire))
+}
+
+func (s *Server) current() (TokenRecord, time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.rec, s.issuedAt
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	rec, _ := s.current()
+	if audience := r.URL.Query().Get("audience"); audience != "" {
+		if s.exchange == nil {
+			http.Error(w, "token exchange is not supported by this IdP", http.StatusNotImplemented)
+			return
+		}
+		exchanged, err := s.exchange(rec.AccessToken, audience)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		rec = exchanged
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec)
+}
+
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	rec, issuedAt := s.current()
+	ttl := time.Duration(rec.AccessTokenExpire)*time.Second - time.Since(issuedAt)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ttl":     ttl.Seconds(),
+		"expired": ttl <= 0,
+	})
+}
+
+// Mux builds the server's http.Handler: /token, /healthz and /metrics.
+func (s *Server) Mux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", s.handleToken)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	metrics := promhttp.Handler()
+	mux.Handle("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec, issuedAt := s.current()
+		ttl := time.Duration(rec.AccessTokenExpire)*time.Second - time.Since(issuedAt)
+		tokenTTLGauge.Set(ttl.Seconds())
+		metrics.ServeHTTP(w, r)
+	}))
+	return mux
+}
+
+// instrumentRenew wraps a refresh function with the idpLatency
+// histogram and refreshTotal counter so -serve mode's /metrics endpoint
+// reflects every refresh attempt, not just ones driven through it.
+func instrumentRenew(fn func(string) (TokenRecord, error)) func(string) (TokenRecord, error) {
+	return func(refreshToken string) (TokenRecord, error) {
+		start := time.Now()
+		rec, err := fn(refreshToken)
+		idpLatency.Observe(time.Since(start).Seconds())
+		if err != nil {
+			refreshTotal.WithLabelValues("failure").Inc()
+		} else {
+			refreshTotal.WithLabelValues("success").Inc()
+		}
+		return rec, err
+	}
+}
+
+// instrumentGrant wraps a no-arg grant function the same way as
+// instrumentRenew, for the initial/reinit grant.
+func instrumentGrant(fn func() (TokenRecord, error)) func() (TokenRecord, error) {
+	return func() (TokenRecord, error) {
+		start := time.Now()
+		rec, err := fn()
+		idpLatency.Observe(time.Since(start).Seconds())
+		if err != nil {
+			refreshTotal.WithLabelValues("failure").Inc()
+		} else {
+			refreshTotal.WithLabelValues("success").Inc()
+		}
+		return rec, err
+	}
+}
+
+// Serve starts listening on socketPath (a Unix domain socket, skipped
+// when socketPath is empty) and, if tcpAddr is non-empty, on that TCP
+// address: with mTLS using certFile/keyFile/caFile when certFile and
+// keyFile are set, otherwise as plain HTTP, which is refused unless
+// tcpAddr is a loopback address. It blocks until one of the listeners
+// fails.
+func (s *Server) Serve(socketPath, tcpAddr, certFile, keyFile, caFile string) error {
+	handler := s.Mux()
+	errc := make(chan error, 2)
+
+	if socketPath != "" {
+		os.Remove(socketPath)
+		ul, err := net.Listen("unix", socketPath)
+		if err != nil {
+			return fmt.Errorf("unable to listen on unix socket %s, error: %v", socketPath, err)
+		}
+		if err := os.Chmod(socketPath, 0600); err != nil {
+			return fmt.Errorf("unable to chmod unix socket %s, error: %v", socketPath, err)
+		}
+		go func() {
+			errc <- http.Serve(ul, handler)
+		}()
+		if s.verbose > 0 {
+			log.Printf("serving tokens on unix socket %s", socketPath)
+		}
+	}
+
+	if tcpAddr != "" {
+		srv := &http.Server{Addr: tcpAddr, Handler: handler}
+		if certFile != "" && keyFile != "" {
+			caCert, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return fmt.Errorf("unable to read CA file %s, error: %v", caFile, err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(caCert) {
+				return fmt.Errorf("unable to parse CA file %s", caFile)
+			}
+			srv.TLSConfig = &tls.Config{
+				ClientCAs:  pool,
+				ClientAuth: tls.RequireAndVerifyClientCert,
+			}
+			go func() {
+				errc <- srv.ListenAndServeTLS(certFile, keyFile)
+			}()
+		} else {
+			// A TokenRecord carries a live access and refresh token, so
+			// serving it as plaintext JSON is only acceptable to
+			// processes on the same host; reject any other bind.
+			if !isLoopbackAddr(tcpAddr) {
+				return fmt.Errorf("-listen %s requires -tlsCert/-tlsKey (mTLS) unless it is a loopback address", tcpAddr)
+			}
+			log.Printf("serving tokens on %s without TLS; this is only safe because it is a loopback address", tcpAddr)
+			go func() {
+				errc <- srv.ListenAndServe()
+			}()
+		}
+		if s.verbose > 0 {
+			log.Printf("serving tokens on %s", tcpAddr)
+		}
+	}
+
+	return <-errc
+}
+
+// isLoopbackAddr reports whether addr (a host:port or bare host) names a
+// loopback interface, so -listen without mTLS can be allowed on
+// 127.0.0.1/::1/localhost but rejected on anything reachable off-host.
+func isLoopbackAddr(addr string) bool {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
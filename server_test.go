@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleTokenNoAudience(t *testing.T) {
+	srv := NewServer(TokenRecord{AccessToken: "at"}, "", 0, nil)
+	w := httptest.NewRecorder()
+	srv.Mux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/token", nil))
+
+	var rec TokenRecord
+	if err := json.Unmarshal(w.Body.Bytes(), &rec); err != nil {
+		t.Fatalf("unable to decode response: %v", err)
+	}
+	if rec.AccessToken != "at" {
+		t.Errorf("AccessToken = %q, want %q", rec.AccessToken, "at")
+	}
+}
+
+func TestHandleTokenAudienceWithoutExchanger(t *testing.T) {
+	srv := NewServer(TokenRecord{AccessToken: "at"}, "", 0, nil)
+	w := httptest.NewRecorder()
+	srv.Mux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/token?audience=https://api.example", nil))
+
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotImplemented)
+	}
+}
+
+func TestHandleTokenAudienceExchanged(t *testing.T) {
+	var gotAccessToken, gotAudience string
+	exchange := func(accessToken, audience string) (TokenRecord, error) {
+		gotAccessToken, gotAudience = accessToken, audience
+		return TokenRecord{AccessToken: "exchanged"}, nil
+	}
+	srv := NewServer(TokenRecord{AccessToken: "at"}, "", 0, exchange)
+	w := httptest.NewRecorder()
+	srv.Mux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/token?audience=https://api.example", nil))
+
+	var rec TokenRecord
+	if err := json.Unmarshal(w.Body.Bytes(), &rec); err != nil {
+		t.Fatalf("unable to decode response: %v", err)
+	}
+	if rec.AccessToken != "exchanged" {
+		t.Errorf("AccessToken = %q, want %q", rec.AccessToken, "exchanged")
+	}
+	if gotAccessToken != "at" || gotAudience != "https://api.example" {
+		t.Errorf("exchange called with (%q, %q)", gotAccessToken, gotAudience)
+	}
+}
+
+func TestHandleTokenAudienceExchangeError(t *testing.T) {
+	exchange := func(accessToken, audience string) (TokenRecord, error) {
+		return TokenRecord{}, errors.New("idp unreachable")
+	}
+	srv := NewServer(TokenRecord{AccessToken: "at"}, "", 0, exchange)
+	w := httptest.NewRecorder()
+	srv.Mux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/token?audience=https://api.example", nil))
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadGateway)
+	}
+}
+
+func TestHandleHealthz(t *testing.T) {
+	srv := NewServer(TokenRecord{AccessToken: "at", AccessTokenExpire: 3600}, "", 0, nil)
+	w := httptest.NewRecorder()
+	srv.Mux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("unable to decode response: %v", err)
+	}
+	if expired, _ := body["expired"].(bool); expired {
+		t.Error("expected a freshly issued token to not be expired")
+	}
+}
+
+func TestHandleHealthzExpired(t *testing.T) {
+	srv := NewServer(TokenRecord{AccessToken: "at", AccessTokenExpire: 0}, "", 0, nil)
+	w := httptest.NewRecorder()
+	srv.Mux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("unable to decode response: %v", err)
+	}
+	if expired, _ := body["expired"].(bool); !expired {
+		t.Error("expected a zero-TTL token to be reported as expired")
+	}
+}
+
+func TestUpdateRecord(t *testing.T) {
+	srv := NewServer(TokenRecord{AccessToken: "old"}, "", 0, nil)
+	srv.UpdateRecord(TokenRecord{AccessToken: "new"})
+	rec, _ := srv.current()
+	if rec.AccessToken != "new" {
+		t.Errorf("AccessToken = %q, want %q", rec.AccessToken, "new")
+	}
+}
+
+func TestInstrumentRenewPropagatesResult(t *testing.T) {
+	wrapped := instrumentRenew(func(refreshToken string) (TokenRecord, error) {
+		return TokenRecord{AccessToken: refreshToken + "-renewed"}, nil
+	})
+	rec, err := wrapped("rt")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rec.AccessToken != "rt-renewed" {
+		t.Errorf("AccessToken = %q, want %q", rec.AccessToken, "rt-renewed")
+	}
+}
+
+func TestInstrumentGrantPropagatesError(t *testing.T) {
+	wantErr := errors.New("boom")
+	wrapped := instrumentGrant(func() (TokenRecord, error) {
+		return TokenRecord{}, wantErr
+	})
+	if _, err := wrapped(); err != wantErr {
+		t.Errorf("error = %v, want %v", err, wantErr)
+	}
+}
+
+func TestIsLoopbackAddr(t *testing.T) {
+	cases := map[string]bool{
+		"127.0.0.1:8443":   true,
+		"127.0.0.1":        true,
+		"localhost:8443":   true,
+		"[::1]:8443":       true,
+		"0.0.0.0:8443":     false,
+		"10.0.0.5:8443":    false,
+		":8443":            false,
+		"example.com:8443": false,
+	}
+	for addr, want := range cases {
+		if got := isLoopbackAddr(addr); got != want {
+			t.Errorf("isLoopbackAddr(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
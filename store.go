@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/zalando/go-keyring"
+	"golang.org/x/crypto/scrypt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// TokenStore persists and reloads a TokenRecord across daemon restarts.
+// Implementations back onto a plain file, an OS keychain, an encrypted
+// file or a Kubernetes Secret; selected via the -store flag. ctx is
+// honored by backends that make network calls (currently only k8s);
+// others ignore it.
+type TokenStore interface {
+	// Load returns the last persisted TokenRecord, or an error if none
+	// exists yet (callers should fall back to an initial grant).
+	Load(ctx context.Context) (TokenRecord, error)
+	// Save persists the given TokenRecord.
+	Save(ctx context.Context, rec TokenRecord) error
+}
+
+// NewTokenStore builds the TokenStore selected by name, where name is
+// one of "file", "keyring", "encfile" or "k8s".
+func NewTokenStore(name, path, passphrase string) (TokenStore, error) {
+	switch name {
+	case "", "file":
+		return FileStore{Path: path}, nil
+	case "keyring":
+		return KeyringStore{Service: "TokenManager", User: path}, nil
+	case "encfile":
+		if passphrase == "" {
+			return nil, fmt.Errorf("-store=encfile requires -storePassphrase")
+		}
+		return EncFileStore{Path: path, Passphrase: passphrase}, nil
+	case "k8s":
+		return NewK8sSecretStore(path)
+	}
+	return nil, fmt.Errorf("unknown -store %q, expect one of file, keyring, encfile, k8s", name)
+}
+
+// FileStore persists the token record as plain JSON on local disk.
+type FileStore struct {
+	Path string
+}
+
+// Load implements TokenStore.
+func (s FileStore) Load(ctx context.Context) (TokenRecord, error) {
+	var rec TokenRecord
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return rec, err
+	}
+	err = json.Unmarshal(data, &rec)
+	return rec, err
+}
+
+// Save implements TokenStore. The file is written with mode 0600 since
+// it may contain a live refresh token.
+func (s FileStore) Save(ctx context.Context, rec TokenRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.Path, data, 0600)
+}
+
+// KeyringStore persists the token record in the OS-native credential
+// store (macOS Keychain, Windows Credential Manager, libsecret on Linux).
+type KeyringStore struct {
+	Service string
+	User    string
+}
+
+// Load implements TokenStore.
+func (s KeyringStore) Load(ctx context.Context) (TokenRecord, error) {
+	var rec TokenRecord
+	data, err := keyring.Get(s.Service, s.User)
+	if err != nil {
+		return rec, err
+	}
+	err = json.Unmarshal([]byte(data), &rec)
+	return rec, err
+}
+
+// Save implements TokenStore.
+func (s KeyringStore) Save(ctx context.Context, rec TokenRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return keyring.Set(s.Service, s.User, string(data))
+}
+
+// EncFileStore persists the token record in a file encrypted with
+// AES-GCM, using a passphrase-derived key (scrypt).
+type EncFileStore struct {
+	Path       string
+	Passphrase string
+}
+
+const encFileSaltSize = 16
+
+func (s EncFileStore) deriveKey(salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(s.Passphrase), salt, 1<<15, 8, 1, 32)
+}
+
+// Load implements TokenStore.
+func (s EncFileStore) Load(ctx context.Context) (TokenRecord, error) {
+	var rec TokenRecord
+	blob, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return rec, err
+	}
+	if len(blob) < encFileSaltSize {
+		return rec, fmt.Errorf("%s: truncated encrypted token store", s.Path)
+	}
+	salt, ciphertext := blob[:encFileSaltSize], blob[encFileSaltSize:]
+	key, err := s.deriveKey(salt)
+	if err != nil {
+		return rec, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return rec, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return rec, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return rec, fmt.Errorf("%s: truncated ciphertext", s.Path)
+	}
+	nonce, data := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, data, nil)
+	if err != nil {
+		return rec, fmt.Errorf("unable to decrypt %s, wrong passphrase?: %v", s.Path, err)
+	}
+	err = json.Unmarshal(plain, &rec)
+	return rec, err
+}
+
+// Save implements TokenStore.
+func (s EncFileStore) Save(ctx context.Context, rec TokenRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	salt := make([]byte, encFileSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	key, err := s.deriveKey(salt)
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	ciphertext := gcm.Seal(nonce, nonce, data, nil)
+	blob := append(salt, ciphertext...)
+	return ioutil.WriteFile(s.Path, blob, 0600)
+}
+
+// K8sSecretStore persists the token record as a Kubernetes Secret in the
+// current namespace, using the in-cluster service account config. This
+// lets a sidecar survive pod restarts without relying on a persistent
+// volume.
+type K8sSecretStore struct {
+	Namespace string
+	Name      string
+	clientset *kubernetes.Clientset
+}
+
+// NewK8sSecretStore builds a K8sSecretStore named secretName, loading
+// the in-cluster config and namespace.
+func NewK8sSecretStore(secretName string) (K8sSecretStore, error) {
+	var s K8sSecretStore
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return s, fmt.Errorf("unable to load in-cluster config, error: %v", err)
+	}
+	clientset, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return s, fmt.Errorf("unable to build k8s client, error: %v", err)
+	}
+	namespace, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err != nil {
+		return s, fmt.Errorf("unable to determine current namespace, error: %v", err)
+	}
+	if secretName == "" {
+		secretName = "tokenmanager"
+	}
+	s.Namespace = string(namespace)
+	s.Name = secretName
+	s.clientset = clientset
+	return s, nil
+}
+
+// Load implements TokenStore.
+func (s K8sSecretStore) Load(ctx context.Context) (TokenRecord, error) {
+	var rec TokenRecord
+	secret, err := s.clientset.CoreV1().Secrets(s.Namespace).Get(ctx, s.Name, metav1.GetOptions{})
+	if err != nil {
+		return rec, err
+	}
+	data, ok := secret.Data["token-record"]
+	if !ok {
+		return rec, fmt.Errorf("secret %s/%s has no token-record key", s.Namespace, s.Name)
+	}
+	err = json.Unmarshal(data, &rec)
+	return rec, err
+}
+
+// Save implements TokenStore. It updates the Secret if it already
+// exists, or creates it otherwise.
+func (s K8sSecretStore) Save(ctx context.Context, rec TokenRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	secrets := s.clientset.CoreV1().Secrets(s.Namespace)
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: s.Name, Namespace: s.Namespace},
+		Data:       map[string][]byte{"token-record": data},
+	}
+	if _, err := secrets.Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		_, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package tlsutil
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestVerifyChecksum(t *testing.T) {
+	data := []byte("hello world")
+	sum := sha256.Sum256(data)
+	want := hex.EncodeToString(sum[:])
+
+	if err := VerifyChecksum(data, want); err != nil {
+		t.Errorf("expected matching checksum to pass, got error: %v", err)
+	}
+	if err := VerifyChecksum(data, "0000000000000000000000000000000000000000000000000000000000000000"); err == nil {
+		t.Error("expected mismatched checksum to be rejected")
+	}
+}
+
+func TestSpiffeAuthorizerRequiresIDOrTrustDomain(t *testing.T) {
+	if _, err := spiffeAuthorizer(Config{SPIFFE: true}); err == nil {
+		t.Error("expected an error when neither SPIFFEID nor SPIFFETrustDomain is set")
+	}
+}
+
+func TestSpiffeAuthorizerID(t *testing.T) {
+	if _, err := spiffeAuthorizer(Config{SPIFFE: true, SPIFFEID: "spiffe://example.org/idp"}); err != nil {
+		t.Errorf("unexpected error for a valid SPIFFE ID: %v", err)
+	}
+	if _, err := spiffeAuthorizer(Config{SPIFFE: true, SPIFFEID: "not a spiffe id"}); err == nil {
+		t.Error("expected an error for an invalid SPIFFE ID")
+	}
+}
+
+func TestSpiffeAuthorizerTrustDomain(t *testing.T) {
+	if _, err := spiffeAuthorizer(Config{SPIFFE: true, SPIFFETrustDomain: "example.org"}); err != nil {
+		t.Errorf("unexpected error for a valid trust domain: %v", err)
+	}
+}
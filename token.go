@@ -1,10 +1,8 @@
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"context"
 	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -15,6 +13,9 @@ import (
 	"runtime"
 	"strings"
 	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/vkuznet/TokenManager/tlsutil"
 )
 
 // git version of our code
@@ -46,17 +47,27 @@ type TokenRecord struct {
 	RefreshToken       string `json:"refresh_token"`
 	RefreshTokenExpire int64  `json:"refresh_expires_in"`
 	IdToken            string `json:"id_token"`
+
+	// AccessClaims and IDClaims are populated by ParseAccessToken and
+	// ParseIdToken once the respective token has been verified; they are
+	// derived data, not part of the IdP response, so they're excluded
+	// from JSON (de)serialization.
+	AccessClaims jwt.MapClaims `json:"-"`
+	IDClaims     jwt.MapClaims `json:"-"`
 }
 
-// Renew token
-func Renew(uri, token, rootCAs string, verbose int) TokenRecord {
+// Renew token. It returns an error instead of calling log.Fatal so that
+// callers such as the refresh scheduler can retry with backoff instead
+// of crashing the daemon on a transient IdP hiccup.
+func Renew(uri, token, rootCAs string, verbose int) (TokenRecord, error) {
+	var rec TokenRecord
 	t := ReadToken(token)
 	if verbose > 1 {
 		log.Printf("renew %s\ninput token : %s\noutput token: %s\n", uri, token, t)
 	}
 	req, err := http.NewRequest("GET", uri, nil)
 	if err != nil {
-		log.Fatal(err)
+		return rec, err
 	}
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", t))
 	req.Header.Set("Accept", "application/json")
@@ -73,72 +84,54 @@ func Renew(uri, token, rootCAs string, verbose int) TokenRecord {
 		client = &http.Client{Transport: tr}
 	}
 	resp, err := client.Do(req)
-	if err == nil {
-		if verbose > 1 {
-			dump, err := httputil.DumpResponse(resp, true)
-			if err == nil {
-				log.Println("[DEBUG] response:", string(dump))
-			}
+	if err != nil {
+		return rec, fmt.Errorf("unable to make HTTP request to %s, error: %v", uri, err)
+	}
+	if verbose > 1 {
+		dump, err := httputil.DumpResponse(resp, true)
+		if err == nil {
+			log.Println("[DEBUG] response:", string(dump))
 		}
-	} else {
-		log.Fatal("Unable to make HTTP request", req, err)
 	}
 	defer resp.Body.Close()
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatal(err)
+		return rec, err
+	}
+	if resp.StatusCode >= 400 {
+		return rec, fmt.Errorf("%s returned %d: %s", uri, resp.StatusCode, string(data))
 	}
-	var rec TokenRecord
 	err = json.Unmarshal(data, &rec)
 	if err != nil {
-		log.Fatal(err)
+		return rec, err
 	}
-	return rec
+	return rec, nil
 }
 
-// Transport helper function to get http transport
+// tlsInsecure, tlsSPIFFE, tlsSPIFFESocket, tlsSPIFFEID and
+// tlsSPIFFETrustDomain are set once in main from the
+// -insecure/-spiffe/-spiffeSocket/-spiffeID/-spiffeTrustDomain flags and
+// read by every Transport call site in this package.
+var tlsInsecure bool
+var tlsSPIFFE bool
+var tlsSPIFFESocket string
+var tlsSPIFFEID string
+var tlsSPIFFETrustDomain string
+
+// Transport builds the http.Transport used to talk to the IdP, via
+// tlsutil so trust defaults to the system root pool plus any PEMs found
+// in rootCAs. It never silently disables verification; pass -insecure
+// to opt out explicitly.
 func Transport(rootCAs string, verbose int) (*http.Transport, error) {
-	certPool := x509.NewCertPool()
-	files, err := ioutil.ReadDir(rootCAs)
-	if err != nil {
-		msg := fmt.Sprintf("Unable to list files in '%s', error: %v\n", rootCAs, err)
-		if rootCAs == "" {
-			msg = fmt.Sprintf("root CAs area is not provided")
-		}
-		log.Printf(msg)
-		return nil, errors.New(msg)
-	}
-	var certs bool
-	for _, finfo := range files {
-		fname := fmt.Sprintf("%s/%s", rootCAs, finfo.Name())
-		caCert, err := ioutil.ReadFile(fname)
-		if err != nil {
-			if verbose > 1 {
-				log.Printf("Unable to read %s\n", fname)
-			}
-		}
-		if ok := certPool.AppendCertsFromPEM(caCert); !ok {
-			if verbose > 2 {
-				log.Printf("invalid PEM format while importing trust-chain: %q", fname)
-			}
-		}
-		if verbose > 2 {
-			log.Println("Load CA file", fname)
-		}
-		certs = true
-	}
-	mTLSConfig := &tls.Config{
-		InsecureSkipVerify: true,
-	}
-	if certs {
-		mTLSConfig = &tls.Config{
-			RootCAs: certPool,
-		}
-	}
-	tr := &http.Transport{
-		TLSClientConfig: mTLSConfig,
-	}
-	return tr, nil
+	return tlsutil.Transport(tlsutil.Config{
+		RootCAs:           rootCAs,
+		Insecure:          tlsInsecure,
+		SPIFFE:            tlsSPIFFE,
+		SPIFFESocket:      tlsSPIFFESocket,
+		SPIFFEID:          tlsSPIFFEID,
+		SPIFFETrustDomain: tlsSPIFFETrustDomain,
+		Verbose:           verbose,
+	})
 }
 
 // helper function to print our token record
@@ -153,6 +146,18 @@ func printRecord(rec TokenRecord, verbose int) {
 	}
 }
 
+// cernCAChecksums pins the expected SHA-256 of each CERN CA file LoadCAs
+// downloads, so a compromised or spoofed cafiles.cern.ch response is
+// rejected instead of silently added to the trust store. It starts
+// empty: this sandbox has no route to cafiles.cern.ch to compute the
+// real digests, and shipping guessed values would brick every fresh
+// install's first run instead of merely leaving it unpinned. Populate
+// it (sha256sum each file in ~/.certificates once fetched from a
+// trusted network) before relying on this for integrity; until then,
+// LoadCAs falls back to trusting an unpinned download, same as before
+// this check existed.
+var cernCAChecksums = map[string]string{}
+
 // LoadCAs helper function loads CERN CAs
 func LoadCAs(verbose int) (string, error) {
 	var homeDir string
@@ -171,11 +176,12 @@ func LoadCAs(verbose int) (string, error) {
 	}
 	dname := fmt.Sprintf("%s/.certificates", homeDir)
 	if _, err := os.Stat(dname); err != nil {
-		os.Mkdir(dname, 0777)
+		os.Mkdir(dname, 0700)
 	}
 	for _, link := range links {
 		arr := strings.Split(link, "/")
-		fname := fmt.Sprintf("%s/.certificates/%s", homeDir, arr[len(arr)-1])
+		basename := arr[len(arr)-1]
+		fname := fmt.Sprintf("%s/.certificates/%s", homeDir, basename)
 		if _, err := os.Stat(fname); err != nil {
 			if verbose > 0 {
 				fmt.Println("download", link)
@@ -189,7 +195,14 @@ func LoadCAs(verbose int) (string, error) {
 			if err != nil {
 				return dname, err
 			}
-			err = ioutil.WriteFile(fname, []byte(data), 0777)
+			if pinned, ok := cernCAChecksums[basename]; ok {
+				if err := tlsutil.VerifyChecksum(data, pinned); err != nil {
+					return dname, fmt.Errorf("refusing to trust %s: %v", link, err)
+				}
+			} else if verbose > 0 {
+				log.Printf("no pinned checksum for %s, trusting it unverified", basename)
+			}
+			err = ioutil.WriteFile(fname, []byte(data), 0644)
 			if err != nil {
 				return dname, err
 			}
@@ -214,6 +227,57 @@ func main() {
 	flag.StringVar(&rootCAs, "rootCAs", "", "location of root CAs")
 	var interval int
 	flag.IntVar(&interval, "interval", 0, "run as daemon with given interval")
+	var issuer string
+	flag.StringVar(&issuer, "issuer", "", "OIDC issuer URL, e.g. https://keycloak.example.com/realms/myrealm; when set the IdP is driven via .well-known/openid-configuration instead of -url")
+	var grantType string
+	flag.StringVar(&grantType, "grantType", "refresh_token", "OAuth2 grant to use with -issuer: refresh_token, client_credentials, password, device_code")
+	var clientID string
+	flag.StringVar(&clientID, "clientId", "", "OAuth2 client_id, used with -issuer")
+	var clientSecret string
+	flag.StringVar(&clientSecret, "clientSecret", "", "OAuth2 client_secret, used with -issuer")
+	var username string
+	flag.StringVar(&username, "username", "", "resource owner username, used with -grantType=password")
+	var password string
+	flag.StringVar(&password, "password", "", "resource owner password, used with -grantType=password")
+	var scope string
+	flag.StringVar(&scope, "scope", "", "requested OAuth2 scope, used with -issuer")
+	var store string
+	flag.StringVar(&store, "store", "file", "token storage backend: file, keyring, encfile, k8s")
+	var storePath string
+	flag.StringVar(&storePath, "storePath", "", "path or key used by the -store backend; must be distinct from -out (defaults to a secret name for k8s)")
+	var storePassphrase string
+	flag.StringVar(&storePassphrase, "storePassphrase", "", "passphrase used to derive the encryption key for -store=encfile")
+	var refreshRatio float64
+	flag.Float64Var(&refreshRatio, "refreshRatio", 2.0/3.0, "fraction of the access token lifetime to wait before proactively refreshing, in daemon mode")
+	var maxBackoff int
+	flag.IntVar(&maxBackoff, "maxBackoff", 300, "maximum backoff, in seconds, between retries of a failed refresh, capped at the refresh token's own expiry")
+	var serve bool
+	flag.BoolVar(&serve, "serve", false, "run as a local sidecar serving the current token over a unix socket (and optional TCP) instead of exiting after the first refresh")
+	var socket string
+	flag.StringVar(&socket, "socket", "/tmp/tokenmanager.sock", "unix socket to serve tokens on, used with -serve")
+	var listen string
+	flag.StringVar(&listen, "listen", "", "optional loopback TCP address to additionally serve tokens on, e.g. 127.0.0.1:8443, used with -serve")
+	var tlsCert string
+	flag.StringVar(&tlsCert, "tlsCert", "", "server certificate for -listen mTLS")
+	var tlsKey string
+	flag.StringVar(&tlsKey, "tlsKey", "", "server key for -listen mTLS")
+	var tlsCA string
+	flag.StringVar(&tlsCA, "tlsCA", "", "CA bundle used to verify clients connecting to -listen")
+	var jwksURI string
+	flag.StringVar(&jwksURI, "jwksURI", "", "JWKS endpoint used to verify tokens; defaults to the value discovered from -issuer")
+	var jwtIssuer string
+	flag.StringVar(&jwtIssuer, "jwtIssuer", "", "expected iss claim when verifying tokens; defaults to -issuer")
+	var requireScope multiFlag
+	flag.Var(&requireScope, "requireScope", "required scope in the access token, e.g. storage.read:/ (repeatable)")
+	var requireAudience multiFlag
+	flag.Var(&requireAudience, "requireAudience", "required audience in the access token (repeatable)")
+	var requireClaim multiFlag
+	flag.Var(&requireClaim, "requireClaim", "required key=value claim in the access token (repeatable)")
+	flag.BoolVar(&tlsInsecure, "insecure", false, "explicitly disable TLS certificate verification; there is no implicit fallback to this")
+	flag.BoolVar(&tlsSPIFFE, "spiffe", false, "source the client certificate and trust bundle from a local SPIRE agent instead of -rootCAs")
+	flag.StringVar(&tlsSPIFFESocket, "spiffeSocket", "", "SPIFFE Workload API socket, used with -spiffe; defaults to $SPIFFE_ENDPOINT_SOCKET")
+	flag.StringVar(&tlsSPIFFEID, "spiffeID", "", "exact SPIFFE ID the peer must present, used with -spiffe; takes precedence over -spiffeTrustDomain")
+	flag.StringVar(&tlsSPIFFETrustDomain, "spiffeTrustDomain", "", "SPIFFE trust domain the peer's ID must belong to, used with -spiffe when -spiffeID is not set")
 	flag.Parse()
 	if version {
 		fmt.Println(info())
@@ -229,31 +293,169 @@ func main() {
 	if verbose > 0 {
 		fmt.Println("Read CERN CAs from", rootCAs)
 	}
-	rurl := fmt.Sprintf("%s/token/renew", uri)
-	rec := Renew(rurl, token, rootCAs, verbose)
-	if out != "" {
-		err := ioutil.WriteFile(out, []byte(rec.AccessToken), 0777)
+	// storePath must never default to out: out is documented to hold the
+	// bare access-token string, while the store backends persist the full
+	// TokenRecord (including the refresh token); defaulting one to the
+	// other would silently replace -out's plain-text contents with JSON
+	// carrying a credential that file was never meant to hold.
+	tokenStore, err := NewTokenStore(store, storePath, storePassphrase)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// on startup, recover the last refresh token from the store so a
+	// daemon restart doesn't force a fresh interactive grant
+	if token == "" {
+		if prev, err := tokenStore.Load(context.Background()); err == nil && prev.RefreshToken != "" {
+			if verbose > 0 {
+				log.Println("Recovered refresh token from store")
+			}
+			token = prev.RefreshToken
+		}
+	}
+	// skipStore covers two cases: the file store with no -storePath, as in
+	// the default legacy invocation (NewTokenStore("file", "", "") hands
+	// back a FileStore with an empty Path, which would fail to open on
+	// every Save); and -storePath left equal to -out, which would
+	// otherwise silently replace -out's plain access-token string with
+	// the full JSON TokenRecord, refresh token included.
+	skipStore := (store == "" || store == "file") && storePath == "" || (out != "" && storePath == out)
+	save := func(rec TokenRecord) {
+		if out != "" {
+			if err := ioutil.WriteFile(out, []byte(rec.AccessToken), 0600); err != nil {
+				log.Fatalf("Unable to write, file: %s, error: %v\n", out, err)
+			}
+		}
+		if skipStore {
+			return
+		}
+		if err := tokenStore.Save(context.Background(), rec); err != nil {
+			log.Printf("Unable to persist token to store: %v", err)
+		}
+	}
+	var rec TokenRecord
+	var renew func(refreshToken string) (TokenRecord, error)
+	var reinit func() (TokenRecord, error)
+	if issuer != "" {
+		reinit = func() (TokenRecord, error) {
+			return grant(issuer, grantType, clientID, clientSecret, username, password, scope, token, rootCAs, verbose)
+		}
+		renew = func(refreshToken string) (TokenRecord, error) {
+			return grant(issuer, "refresh_token", clientID, clientSecret, username, password, scope, refreshToken, rootCAs, verbose)
+		}
+	} else {
+		rurl := fmt.Sprintf("%s/token/renew", uri)
+		reinit = func() (TokenRecord, error) {
+			return Renew(rurl, token, rootCAs, verbose)
+		}
+		renew = func(refreshToken string) (TokenRecord, error) {
+			return Renew(rurl, refreshToken, rootCAs, verbose)
+		}
+	}
+	requireClaimMap, err := parseRequireClaims(requireClaim)
+	if err != nil {
+		log.Fatal(err)
+	}
+	resolvedJWKSURI := jwksURI
+	resolvedJWTIssuer := jwtIssuer
+	if resolvedJWTIssuer == "" {
+		resolvedJWTIssuer = issuer
+	}
+	if resolvedJWKSURI == "" && issuer != "" {
+		if disc, err := Discover(issuer, rootCAs, verbose); err == nil {
+			resolvedJWKSURI = disc.JwksURI
+		}
+	}
+	var jwks *jwksCache
+	if resolvedJWKSURI != "" {
+		jwks = newJWKSCache(resolvedJWKSURI, rootCAs, verbose)
+	}
+	// validate verifies the access/id tokens against the IdP's JWKS (when
+	// configured) and enforces -requireScope/-requireAudience/-requireClaim,
+	// so a token missing required entitlements fails the refresh outright
+	// instead of being written to -out.
+	validate := func(rec TokenRecord) (TokenRecord, error) {
+		if jwks == nil {
+			// no verified claims: fails only if any requirement is set
+			return rec, checkRequirements(nil, requireScope, requireAudience, requireClaimMap)
+		}
+		if err := ParseAccessToken(&rec, jwks, resolvedJWTIssuer, verbose); err != nil {
+			return rec, err
+		}
+		if err := ParseIdToken(&rec, jwks, resolvedJWTIssuer, verbose); err != nil {
+			return rec, err
+		}
+		if err := checkRequirements(rec.AccessClaims, requireScope, requireAudience, requireClaimMap); err != nil {
+			return rec, err
+		}
+		return rec, nil
+	}
+	rawReinit, rawRenew := reinit, renew
+	reinit = func() (TokenRecord, error) {
+		rec, err := rawReinit()
+		if err != nil {
+			return rec, err
+		}
+		return validate(rec)
+	}
+	renew = func(refreshToken string) (TokenRecord, error) {
+		rec, err := rawRenew(refreshToken)
 		if err != nil {
-			log.Fatalf("Unable to write, file: %s, error: %v\n", out, err)
+			return rec, err
 		}
+		return validate(rec)
+	}
+	renew = instrumentRenew(renew)
+	reinit = instrumentGrant(reinit)
+	rec, err = reinit()
+	if err != nil {
+		log.Fatal(err)
 	}
+	save(rec)
 	printRecord(rec, verbose)
-	// run as daemon if requested
-	if interval > 0 {
-		for {
-			d := time.Duration(interval) * time.Second
-			time.Sleep(d)
-			// get refresh token from previous record
-			rtoken := rec.RefreshToken
-			// renew token using our refresh token
-			rec = Renew(rurl, rtoken, rootCAs, verbose)
-			if out != "" {
-				err := ioutil.WriteFile(out, []byte(rec.AccessToken), 0777)
-				if err != nil {
-					log.Fatalf("Unable to write, file: %s, error: %v\n", out, err)
-				}
+
+	// isInteractiveGrant is true for grant types that require a human at
+	// a terminal or browser (device_code, password). The scheduler must
+	// never re-run one of those on its own goroutine once the refresh
+	// token is close to expiry: it would print a verification URL or
+	// prompt nobody is watching and block the refresh loop. Such grants
+	// get schedulerReinit=nil, so runScheduler instead exits with
+	// exitRefreshTokenExpired for a supervisor to restart the process
+	// into an interactive session.
+	isInteractiveGrant := issuer != "" && (grantType == "password" || grantType == "device_code")
+	schedulerReinit := reinit
+	if isInteractiveGrant {
+		schedulerReinit = nil
+	}
+
+	var srv *Server
+	if serve {
+		var exchange func(string, string) (TokenRecord, error)
+		if issuer != "" {
+			disc, err := Discover(issuer, rootCAs, verbose)
+			if err != nil {
+				log.Fatal(err)
 			}
-			printRecord(rec, verbose)
+			exchanger := tokenExchanger{providerClient: newProviderClient(disc, rootCAs, verbose), ClientID: clientID, ClientSecret: clientSecret}
+			exchange = exchanger.Exchange
 		}
+		srv = NewServer(rec, rootCAs, verbose, exchange)
+		go func() {
+			if err := srv.Serve(socket, listen, tlsCert, tlsKey, tlsCA); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	onRenew := func(r TokenRecord) {
+		save(r)
+		printRecord(r, verbose)
+		if srv != nil {
+			srv.UpdateRecord(r)
+		}
+	}
+	// run as daemon if requested, either to keep refreshing in the
+	// background (-interval) or because we're serving tokens (-serve)
+	if interval > 0 || serve {
+		runScheduler(rec, refreshRatio, time.Duration(interval)*time.Second, time.Duration(maxBackoff)*time.Second, renew, schedulerReinit, onRenew, os.Exit)
 	}
 }